@@ -0,0 +1,134 @@
+package buildah
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"hash"
+	"io"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// ChunkDigest records the digest of one fixed-size window of a single
+// file's contents, as seen while a tarDigester with a non-zero chunk size
+// streamed through it.
+type ChunkDigest struct {
+	Path   string
+	Offset int64
+	Size   int64
+	Digest digest.Digest
+}
+
+// chunkDigester is implemented by digesters which can report the
+// ChunkDigest values they recorded while digesting, such as a tarDigester
+// constructed with newTarDigesterWithChunkSize.
+type chunkDigester interface {
+	ChunkDigests() []ChunkDigest
+}
+
+// chunkTracker accumulates one file's content into fixed-size windows,
+// appending a ChunkDigest to *chunks each time a window fills up or the
+// file ends.
+type chunkTracker struct {
+	path      string
+	chunkSize int64
+	chunks    *[]ChunkDigest
+	hasher    hash.Hash
+	chunkLen  int64
+	offset    int64
+}
+
+func newChunkTracker(path string, chunkSize int64, chunks *[]ChunkDigest) *chunkTracker {
+	return &chunkTracker{
+		path:      path,
+		chunkSize: chunkSize,
+		chunks:    chunks,
+		hasher:    sha256.New(),
+	}
+}
+
+func (c *chunkTracker) write(p []byte) {
+	for len(p) > 0 {
+		room := c.chunkSize - c.chunkLen
+		n := int64(len(p))
+		if n > room {
+			n = room
+		}
+		c.hasher.Write(p[:n])
+		c.chunkLen += n
+		p = p[n:]
+		if c.chunkLen == c.chunkSize {
+			c.flush()
+		}
+	}
+}
+
+// flush records the current window as a ChunkDigest and starts a new one.
+// It's a no-op if nothing has been written to the current window yet.
+func (c *chunkTracker) flush() {
+	if c.chunkLen == 0 {
+		return
+	}
+	*c.chunks = append(*c.chunks, ChunkDigest{
+		Path:   c.path,
+		Offset: c.offset,
+		Size:   c.chunkLen,
+		Digest: digest.NewDigest(digest.SHA256, c.hasher),
+	})
+	c.offset += c.chunkLen
+	c.chunkLen = 0
+	c.hasher = sha256.New()
+}
+
+// chunkTrackingReader wraps a tar entry's content reader, feeding every
+// byte that passes through it to a chunkTracker as it goes.
+type chunkTrackingReader struct {
+	src     io.Reader
+	tracker *chunkTracker
+}
+
+func (r *chunkTrackingReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	if n > 0 {
+		r.tracker.write(p[:n])
+	}
+	if err == io.EOF {
+		r.tracker.flush()
+	}
+	return n, err
+}
+
+// trackChunks parses the tar stream read from pipeReader purely to learn
+// entry boundaries, accumulating a ChunkDigest per t.chunkSize-sized window
+// of every regular file's contents into t.chunks. It never writes the
+// parsed entries anywhere; the bytes reaching the compressor are fed by a
+// separate io.MultiWriter branch in newTarDigesterWithChunkSize, so a
+// parsing error here can't change what gets digested.
+func (t *tarDigester) trackChunks(pipeReader *io.PipeReader) {
+	defer t.chunkWG.Done()
+	defer func() {
+		// Keep reading until the writer side is closed, so that writes
+		// to the tee never fail after parsing stops early.
+		_, _ = io.Copy(io.Discard, pipeReader)
+		pipeReader.Close()
+	}()
+	tarReader := tar.NewReader(pipeReader)
+	for {
+		hdr, err := tarReader.Next()
+		if err != nil {
+			if err != io.EOF {
+				t.chunkErr = err
+			}
+			return
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+			continue
+		}
+		tracker := newChunkTracker(hdr.Name, t.chunkSize, &t.chunks)
+		wrapped := &chunkTrackingReader{src: tarReader, tracker: tracker}
+		if _, err := io.Copy(io.Discard, wrapped); err != nil {
+			t.chunkErr = err
+			return
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package buildah
+
+import "testing"
+
+// TestTarDigesterChunkSizeDoesNotAffectDigest guards against a regression
+// where turning on WithChunkSize routed the tar stream through a
+// re-serializing filter, making Digest() depend on an option that's only
+// supposed to add instrumentation.
+func TestTarDigesterChunkSizeDoesNotAffectDigest(t *testing.T) {
+	input := buildTestTar(t, map[string]string{
+		"a.txt": "hello, world",
+		"b.txt": "some other contents, long enough to span a couple of small chunks",
+	})
+
+	plain := newTarDigester("file", nil)
+	if _, err := plain.Write(input); err != nil {
+		t.Fatalf("error writing to plain digester: %v", err)
+	}
+	if err := plain.Close(); err != nil {
+		t.Fatalf("error closing plain digester: %v", err)
+	}
+
+	chunked := newTarDigesterWithChunkSize("file", nil, 8)
+	if _, err := chunked.Write(input); err != nil {
+		t.Fatalf("error writing to chunked digester: %v", err)
+	}
+	if err := chunked.Close(); err != nil {
+		t.Fatalf("error closing chunked digester: %v", err)
+	}
+
+	if plain.Digest() != chunked.Digest() {
+		t.Fatalf("enabling chunk tracking changed the digest: %s vs %s", plain.Digest(), chunked.Digest())
+	}
+
+	chunks := chunked.(chunkDigester).ChunkDigests()
+	if len(chunks) == 0 {
+		t.Fatalf("expected chunk tracking to record at least one ChunkDigest")
+	}
+}
@@ -0,0 +1,232 @@
+package buildah
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressor wraps a writer so that everything written to the result is
+// compressed on its way to the underlying writer, and describes the
+// compression that it applies. Digesters use it to decide what bytes they
+// should actually be hashing.
+type Compressor interface {
+	// Writer returns an io.WriteCloser which compresses everything
+	// written to it and passes the result along to w. Closing it
+	// flushes and finalizes the compressed stream, but does not close
+	// w.
+	Writer(w io.Writer) (io.WriteCloser, error)
+	// ContentType returns a short, human-readable name for the
+	// compression that this Compressor applies, such as "gzip", "zstd",
+	// or "zstd:chunked".
+	ContentType() string
+	// MediaTypeSuffix returns the suffix that should be appended to an
+	// OCI media type to reflect this compression, such as "gzip" or
+	// "zstd". It's empty for uncompressed content.
+	MediaTypeSuffix() string
+}
+
+// nopWriteCloser adapts an io.Writer that doesn't need to be flushed or
+// finalized to the io.WriteCloser signature that Compressor.Writer needs to
+// return.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// identityCompressor passes bytes through unmodified. It's the default
+// used by newTarDigester, to preserve the historical, uncompressed tar
+// digest.
+type identityCompressor struct{}
+
+func (identityCompressor) Writer(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (identityCompressor) ContentType() string {
+	return ""
+}
+
+func (identityCompressor) MediaTypeSuffix() string {
+	return ""
+}
+
+// GzipCompressor returns a Compressor that produces a standard,
+// single-stream gzip file.
+func GzipCompressor() Compressor {
+	return gzipCompressor{}
+}
+
+// gzipCompressor produces a standard, single-stream gzip file.
+type gzipCompressor struct{}
+
+func (gzipCompressor) Writer(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCompressor) ContentType() string {
+	return "gzip"
+}
+
+func (gzipCompressor) MediaTypeSuffix() string {
+	return "gzip"
+}
+
+// ZstdCompressor returns a Compressor that produces a standard,
+// single-frame zstd stream.
+func ZstdCompressor() Compressor {
+	return zstdCompressor{}
+}
+
+// zstdCompressor produces a standard, single-frame zstd stream.
+type zstdCompressor struct{}
+
+func (zstdCompressor) Writer(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+
+func (zstdCompressor) ContentType() string {
+	return "zstd"
+}
+
+func (zstdCompressor) MediaTypeSuffix() string {
+	return "zstd"
+}
+
+const (
+	// zstdChunkedChunkSize is the default size of the pieces that
+	// zstdchunkedCompressor splits its input into before compressing
+	// each piece as an independent zstd frame.
+	zstdChunkedChunkSize = 4 * 1024 * 1024
+
+	// zstdChunkedManifestMagic is the reserved skippable-frame magic
+	// number (the low nibble of the frame ID is arbitrary within the
+	// 0x184D2A5{0-F} skippable-frame range) used to mark the trailing
+	// frame that holds zstdChunkedManifest as JSON.
+	zstdChunkedManifestMagic = 0x184D2A50
+)
+
+// zstdChunkedManifestEntry records where one compressed chunk begins in
+// the finished stream, and the digest of its uncompressed content.
+type zstdChunkedManifestEntry struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+}
+
+// zstdChunkedManifest is the JSON document stored in the trailing
+// skippable frame of a zstd:chunked stream.
+type zstdChunkedManifest struct {
+	Version int                        `json:"version"`
+	Chunks  []zstdChunkedManifestEntry `json:"chunks"`
+}
+
+// ZstdChunkedCompressor returns a Compressor that produces a zstd:chunked
+// stream, suitable for use with WithCompressor.
+func ZstdChunkedCompressor() Compressor {
+	return zstdchunkedCompressor{}
+}
+
+// zstdchunkedCompressor produces a zstd stream in which the input has been
+// split into independently-compressed zstd frames, with a trailing
+// skippable frame carrying a manifest of chunk offsets and digests. The
+// result is still a valid zstd stream, but a reader that understands the
+// manifest can seek to and decompress a single chunk without reading
+// everything ahead of it.
+type zstdchunkedCompressor struct{}
+
+func (zstdchunkedCompressor) Writer(w io.Writer) (io.WriteCloser, error) {
+	return &zstdChunkedWriter{dest: &countingWriter{w: w}, chunkSize: zstdChunkedChunkSize}, nil
+}
+
+func (zstdchunkedCompressor) ContentType() string {
+	return "zstd:chunked"
+}
+
+func (zstdchunkedCompressor) MediaTypeSuffix() string {
+	return "zstd"
+}
+
+type zstdChunkedWriter struct {
+	dest      *countingWriter
+	buf       bytes.Buffer
+	chunkSize int64
+	manifest  zstdChunkedManifest
+}
+
+func (z *zstdChunkedWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		room := int(z.chunkSize) - z.buf.Len()
+		if room <= 0 {
+			if err := z.flushChunk(); err != nil {
+				return total, err
+			}
+			room = int(z.chunkSize)
+		}
+		n := len(p)
+		if n > room {
+			n = room
+		}
+		written, err := z.buf.Write(p[:n])
+		total += written
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// flushChunk compresses whatever has been buffered since the last chunk as
+// its own zstd frame, and records its offset and digest in the manifest.
+func (z *zstdChunkedWriter) flushChunk() error {
+	if z.buf.Len() == 0 {
+		return nil
+	}
+	offset := z.dest.n
+	sum := sha256.Sum256(z.buf.Bytes())
+	enc, err := zstd.NewWriter(z.dest)
+	if err != nil {
+		return err
+	}
+	if _, err := enc.Write(z.buf.Bytes()); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	z.manifest.Chunks = append(z.manifest.Chunks, zstdChunkedManifestEntry{
+		Offset: offset,
+		Size:   int64(z.buf.Len()),
+		Digest: "sha256:" + hex.EncodeToString(sum[:]),
+	})
+	z.buf.Reset()
+	return nil
+}
+
+func (z *zstdChunkedWriter) Close() error {
+	if err := z.flushChunk(); err != nil {
+		return err
+	}
+	z.manifest.Version = 1
+	manifestBytes, err := json.Marshal(&z.manifest)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 8+len(manifestBytes))
+	binary.LittleEndian.PutUint32(frame[0:4], zstdChunkedManifestMagic)
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(len(manifestBytes)))
+	copy(frame[8:], manifestBytes)
+	_, err = z.dest.Write(frame)
+	return err
+}
@@ -0,0 +1,143 @@
+package buildah
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestGzipCompressorContentTypeAndDigest(t *testing.T) {
+	input := []byte("some tar bytes, doesn't matter for this test")
+	d := newTarDigester("file", GzipCompressor())
+	if _, err := d.Write(input); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("error closing: %v", err)
+	}
+	if d.ContentType() != "file+gzip" {
+		t.Fatalf("expected content type %q, got %q", "file+gzip", d.ContentType())
+	}
+	if d.Digest() == "" {
+		t.Fatalf("expected a non-empty digest")
+	}
+}
+
+// TestTarDigesterContentTypeReflectsCompressor verifies that the media
+// type suffix a Compressor reports is surfaced through ContentType(), so a
+// caller of CompositeDigester.Digest()/Hash() can tell which compression
+// was actually applied instead of always seeing the bare "file"/"dir"
+// label regardless of compressor.
+func TestTarDigesterContentTypeReflectsCompressor(t *testing.T) {
+	cases := []struct {
+		name       string
+		compressor Compressor
+		want       string
+	}{
+		{"uncompressed", nil, "dir"},
+		{"gzip", GzipCompressor(), "dir+gzip"},
+		{"zstd", ZstdCompressor(), "dir+zstd"},
+		{"zstd:chunked", ZstdChunkedCompressor(), "dir+zstd"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newTarDigester("dir", tc.compressor)
+			if _, err := d.Write([]byte("irrelevant")); err != nil {
+				t.Fatalf("error writing: %v", err)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatalf("error closing: %v", err)
+			}
+			if d.ContentType() != tc.want {
+				t.Fatalf("expected content type %q, got %q", tc.want, d.ContentType())
+			}
+		})
+	}
+}
+
+// TestZstdChunkedCompressorManifest splits a multi-chunk input through the
+// zstd:chunked compressor and verifies that every chunk the manifest
+// records decompresses, at its stated offset, to bytes matching its
+// recorded digest, and that the chunk frames ahead of the manifest frame
+// decode end to end, with a plain zstd decoder, back to the original input.
+func TestZstdChunkedCompressorManifest(t *testing.T) {
+	chunkSize := int64(16)
+	compressor := zstdchunkedCompressor{}
+	out := &bytes.Buffer{}
+	writer, err := (func() (*zstdChunkedWriter, error) {
+		w, err := compressor.Writer(out)
+		if err != nil {
+			return nil, err
+		}
+		return w.(*zstdChunkedWriter), nil
+	})()
+	if err != nil {
+		t.Fatalf("error constructing zstd:chunked writer: %v", err)
+	}
+	writer.chunkSize = chunkSize
+
+	input := []byte("0123456789abcdef0123456789abcdefXYZ")
+	if _, err := writer.Write(input); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("error closing: %v", err)
+	}
+
+	// The stream is a sequence of standard zstd frames; find the
+	// trailing skippable manifest frame by its magic number.
+	raw := out.Bytes()
+	if len(raw) < 8 {
+		t.Fatalf("output too short to contain a manifest frame")
+	}
+
+	manifestOffset := -1
+	for i := 0; i+8 <= len(raw); i++ {
+		if binary.LittleEndian.Uint32(raw[i:i+4]) == zstdChunkedManifestMagic {
+			manifestOffset = i
+			break
+		}
+	}
+	if manifestOffset < 0 {
+		t.Fatalf("no zstd:chunked manifest frame found in output")
+	}
+	manifestLen := binary.LittleEndian.Uint32(raw[manifestOffset+4 : manifestOffset+8])
+	var manifest zstdChunkedManifest
+	if err := json.Unmarshal(raw[manifestOffset+8:manifestOffset+8+int(manifestLen)], &manifest); err != nil {
+		t.Fatalf("error decoding manifest: %v", err)
+	}
+	if len(manifest.Chunks) == 0 {
+		t.Fatalf("expected at least one recorded chunk")
+	}
+
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatalf("error constructing zstd decoder: %v", err)
+	}
+	defer dec.Close()
+
+	for _, chunk := range manifest.Chunks {
+		decoded, err := dec.DecodeAll(raw[chunk.Offset:manifestOffset], nil)
+		if err != nil {
+			t.Fatalf("error decoding chunk at offset %d: %v", chunk.Offset, err)
+		}
+		sum := sha256.Sum256(decoded[:chunk.Size])
+		gotDigest := "sha256:" + hex.EncodeToString(sum[:])
+		if gotDigest != chunk.Digest {
+			t.Fatalf("chunk at offset %d: digest mismatch: got %s, want %s", chunk.Offset, gotDigest, chunk.Digest)
+		}
+	}
+
+	full, err := dec.DecodeAll(raw[:manifestOffset], nil)
+	if err != nil {
+		t.Fatalf("error decoding full zstd:chunked payload: %v", err)
+	}
+	if !bytes.Equal(full, input) {
+		t.Fatalf("decoded zstd:chunked payload didn't round-trip: got %q, want %q", full, input)
+	}
+}
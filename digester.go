@@ -2,9 +2,11 @@ package buildah
 
 import (
 	"archive/tar"
+	"bytes"
 	"fmt"
 	"hash"
 	"io"
+	"runtime"
 	"sync"
 
 	digest "github.com/opencontainers/go-digest"
@@ -72,7 +74,33 @@ func (t *tarFilterer) Close() error {
 
 // newTarFilterer passes a tarball through to an io.WriteCloser, potentially
 // calling filter to modify headers as it goes.
+//
+// Deprecated: filter can only rewrite the header of an entry, not its body,
+// and can't drop or add entries. New code that needs to do those things
+// should call newTarFiltererV2 instead.
 func newTarFilterer(writeCloser io.WriteCloser, filter func(hdr *tar.Header)) io.WriteCloser {
+	if filter == nil {
+		return newTarFiltererV2(writeCloser, nil)
+	}
+	return newTarFiltererV2(writeCloser, func(hdr *tar.Header, contents io.Reader) (*tar.Header, io.Reader, []tar.Header, error) {
+		filter(hdr)
+		return hdr, contents, nil, nil
+	})
+}
+
+// TarEntryFilter is called once per entry as a tarFilterer streams a
+// tarball through. It may return a modified copy of hdr and/or a
+// replacement reader for the entry's contents, a list of extra entries to
+// write out immediately afterward (each written with no contents, so each
+// needs a Size of zero), or a nil newHdr to drop the entry from the output
+// entirely.
+type TarEntryFilter func(hdr *tar.Header, contents io.Reader) (newHdr *tar.Header, newContents io.Reader, extra []tar.Header, err error)
+
+// newTarFiltererV2 passes a tarball through to an io.WriteCloser, calling
+// filter for each entry so that it can rewrite headers and bodies, drop
+// entries, or splice in additional entries, none of which the older,
+// header-only newTarFilterer callback can do.
+func newTarFiltererV2(writeCloser io.WriteCloser, filter TarEntryFilter) io.WriteCloser {
 	pipeReader, pipeWriter := io.Pipe()
 	tarReader := tar.NewReader(pipeReader)
 	tarWriter := tar.NewWriter(writeCloser)
@@ -83,22 +111,23 @@ func newTarFilterer(writeCloser io.WriteCloser, filter func(hdr *tar.Header)) io
 	go func() {
 		hdr, err := tarReader.Next()
 		for err == nil {
+			newHdr := hdr
+			var newContents io.Reader = tarReader
+			var extra []tar.Header
 			if filter != nil {
-				filter(hdr)
-			}
-			err = tarWriter.WriteHeader(hdr)
-			if err != nil {
-				err = errors.Wrapf(err, "error filtering tar header for %q", hdr.Name)
-				break
+				newHdr, newContents, extra, err = filter(hdr, io.LimitReader(tarReader, hdr.Size))
+				if err != nil {
+					err = errors.Wrapf(err, "error filtering tar header for %q", hdr.Name)
+					break
+				}
 			}
-			if hdr.Size != 0 {
-				n, copyErr := io.Copy(tarWriter, tarReader)
-				if copyErr != nil {
-					err = errors.Wrapf(copyErr, "error filtering content for %q", hdr.Name)
+			if newHdr != nil {
+				if err = writeFilteredTarEntry(tarWriter, newHdr, newContents); err != nil {
 					break
 				}
-				if n != hdr.Size {
-					err = errors.Errorf("error filtering content for %q: expected %d bytes, got %d bytes", hdr.Name, hdr.Size, n)
+			}
+			for i := range extra {
+				if err = writeFilteredTarEntry(tarWriter, &extra[i], bytes.NewReader(nil)); err != nil {
 					break
 				}
 			}
@@ -115,27 +144,99 @@ func newTarFilterer(writeCloser io.WriteCloser, filter func(hdr *tar.Header)) io
 	return filterer
 }
 
+// writeFilteredTarEntry writes one header, and up to hdr.Size bytes of
+// contents, to tarWriter.
+func writeFilteredTarEntry(tarWriter *tar.Writer, hdr *tar.Header, contents io.Reader) error {
+	if err := tarWriter.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "error filtering tar header for %q", hdr.Name)
+	}
+	if hdr.Size != 0 {
+		n, err := io.Copy(tarWriter, contents)
+		if err != nil {
+			return errors.Wrapf(err, "error filtering content for %q", hdr.Name)
+		}
+		if n != hdr.Size {
+			return errors.Errorf("error filtering content for %q: expected %d bytes, got %d bytes", hdr.Name, hdr.Size, n)
+		}
+	}
+	return nil
+}
+
 // A tar digester digests an archive, modifying the headers it digests by
 // calling a specified function to potentially modify the header that it's
 // about to write.
 type tarDigester struct {
-	isOpen      bool
-	nested      digester
-	tarFilterer io.WriteCloser
+	isOpen          bool
+	nested          digester
+	compressWriter  io.WriteCloser
+	mediaTypeSuffix string
+	out             io.Writer
+	chunkSize       int64
+	chunks          []ChunkDigest
+	chunkPipeWriter *io.PipeWriter
+	chunkWG         sync.WaitGroup
+	chunkErr        error
 }
 
-func newTarDigester(contentType string) digester {
+// newTarDigester returns a digester which hashes a tar stream after passing
+// it through compressor. Passing identityCompressor{} reproduces the
+// historical behavior of hashing the tar stream as-is.
+func newTarDigester(contentType string, compressor Compressor) digester {
+	return newTarDigesterWithChunkSize(contentType, compressor, 0)
+}
+
+// newTarDigesterWithChunkSize is like newTarDigester, but if chunkSize is
+// greater than zero, every byte written is also teed to a background parser
+// which tracks a rolling sha256 over each chunkSize-sized window of every
+// regular file's contents, retrievable afterward with ChunkDigests(). The
+// tee is read-only: bytes reach the compressor exactly as newTarDigester
+// would pass them, so Digest() never depends on whether chunk tracking is
+// turned on.
+func newTarDigesterWithChunkSize(contentType string, compressor Compressor, chunkSize int64) digester {
+	if compressor == nil {
+		compressor = identityCompressor{}
+	}
 	nested := newSimpleDigester(contentType)
-	digester := &tarDigester{
-		isOpen:      true,
-		nested:      nested,
-		tarFilterer: nested,
+	compressWriter, err := compressor.Writer(nested)
+	if err != nil {
+		panic(fmt.Sprintf("error setting up %s compressor: %v", compressor.ContentType(), err))
 	}
-	return digester
+	t := &tarDigester{
+		isOpen:          true,
+		nested:          nested,
+		compressWriter:  compressWriter,
+		mediaTypeSuffix: compressor.MediaTypeSuffix(),
+		out:             compressWriter,
+		chunkSize:       chunkSize,
+	}
+	if chunkSize > 0 {
+		pipeReader, pipeWriter := io.Pipe()
+		t.chunkPipeWriter = pipeWriter
+		t.out = io.MultiWriter(compressWriter, pipeWriter)
+		t.chunkWG.Add(1)
+		go t.trackChunks(pipeReader)
+	}
+	return t
 }
 
+// ChunkDigests returns the per-window digests recorded for each regular
+// file seen so far, in the order their windows were completed. It's empty
+// unless this digester was constructed with newTarDigesterWithChunkSize
+// and a positive chunk size.
+func (t *tarDigester) ChunkDigests() []ChunkDigest {
+	return t.chunks
+}
+
+// ContentType returns the nested content type ("file" or "dir"), with the
+// compressor's MediaTypeSuffix appended after a "+" when compression is in
+// use, so a caller of CompositeDigester.Digest()/Hash() can tell which
+// compression (and so which OCI media type suffix) was actually applied,
+// e.g. "file+zstd" for a "file" item digested with ZstdCompressor().
 func (t *tarDigester) ContentType() string {
-	return t.nested.ContentType()
+	if t.mediaTypeSuffix == "" {
+		return t.nested.ContentType()
+	}
+	return t.nested.ContentType() + "+" + t.mediaTypeSuffix
 }
 
 func (t *tarDigester) Digest() digest.Digest {
@@ -143,24 +244,106 @@ func (t *tarDigester) Digest() digest.Digest {
 }
 
 func (t *tarDigester) Write(p []byte) (int, error) {
-	return t.tarFilterer.Write(p)
+	return t.out.Write(p)
 }
 
 func (t *tarDigester) Close() error {
-	if t.isOpen {
-		t.isOpen = false
-		return t.tarFilterer.Close()
+	if !t.isOpen {
+		return nil
+	}
+	t.isOpen = false
+	err := t.compressWriter.Close()
+	if t.chunkPipeWriter != nil {
+		if closeErr := t.chunkPipeWriter.Close(); err == nil {
+			err = closeErr
+		}
+		t.chunkWG.Wait()
+		if err == nil {
+			err = t.chunkErr
+		}
+	}
+	return err
+}
+
+// digesterOptions holds the settings that DigesterOption functions fill in,
+// for use by CompositeDigester.Start when it constructs a new item's
+// digester.
+type digesterOptions struct {
+	prioritizedFiles []string
+	compressor       Compressor
+	chunkSize        int64
+}
+
+// A DigesterOption customizes the digester that CompositeDigester.Start
+// constructs for a new item.
+type DigesterOption func(*digesterOptions)
+
+// WithPrioritizedFiles names files to be treated as high priority by a
+// content type that records a TOC, such as "file-estargz" and
+// "dir-estargz". If any named file appears in the item, a single
+// ".prefetch.landmark" entry is appended after the item's last entry, and
+// the names are reported by CompositeDigester.EstargzTOC. Entries are not
+// reordered, so the landmark follows every entry of the item, not only the
+// named ones, and the TOC's entries carry no per-file priority mark.
+func WithPrioritizedFiles(files []string) DigesterOption {
+	return func(o *digesterOptions) {
+		o.prioritizedFiles = append(o.prioritizedFiles, files...)
+	}
+}
+
+// WithCompressor selects the compression that a "file" or "dir" item's
+// digester applies to the tar stream before hashing it, such as
+// gzipCompressor{}, zstdCompressor{}, or zstdchunkedCompressor{}. Without
+// this option, the tar stream is hashed uncompressed, as it always has
+// been.
+func WithCompressor(compressor Compressor) DigesterOption {
+	return func(o *digesterOptions) {
+		o.compressor = compressor
+	}
+}
+
+// WithChunkSize sets the chunk size a digester splits a regular file's
+// contents into. For a "file" or "dir" item, it turns on per-window chunk
+// digests, recording a rolling sha256 over each chunkSize-sized window,
+// retrievable afterward through CompositeDigester.PerItemChunks; without
+// this option, no chunk digests are recorded. For a "file-estargz" or
+// "dir-estargz" item, it overrides the size of the pieces that each
+// file's contents are split into before being gzip-compressed
+// independently (default estargzChunkSize).
+func WithChunkSize(chunkSize int64) DigesterOption {
+	return func(o *digesterOptions) {
+		o.chunkSize = chunkSize
 	}
-	return nil
 }
 
 // CompositeDigester can compute a digest over multiple items.
+//
+// All exported methods are safe to call from multiple goroutines; mu
+// guards digesters, closer, maxWorkers, and workerSem, which StartParallel
+// would otherwise mutate concurrently with any other Start/StartParallel
+// call racing it.
 type CompositeDigester struct {
-	digesters []digester
-	closer    io.Closer
+	mu         sync.Mutex
+	digesters  []digester
+	closer     io.Closer
+	maxWorkers int
+	parallelWG sync.WaitGroup
+	workerSem  chan struct{}
+}
+
+// WithMaxWorkers caps the number of items that StartParallel will digest
+// concurrently. The default, if this is never called or is called with n
+// <= 0, is runtime.GOMAXPROCS(0).
+func (c *CompositeDigester) WithMaxWorkers(n int) *CompositeDigester {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxWorkers = n
+	c.workerSem = nil
+	return c
 }
 
-// closeOpenDigester closes an open sub-digester, if we have one.
+// closeOpenDigester closes an open sub-digester, if we have one. The caller
+// must hold c.mu.
 func (c *CompositeDigester) closeOpenDigester() {
 	if c.closer != nil {
 		c.closer.Close()
@@ -170,29 +353,113 @@ func (c *CompositeDigester) closeOpenDigester() {
 
 // Restart clears all state, so that the composite digester can start over.
 func (c *CompositeDigester) Restart() {
+	c.mu.Lock()
 	c.closeOpenDigester()
+	c.mu.Unlock()
+	c.parallelWG.Wait()
+	c.mu.Lock()
 	c.digesters = nil
+	c.mu.Unlock()
 }
 
-// Start starts recording the digest for a new item ("", "file", or "dir").
-// The caller should call Hash() immediately after to retrieve the new
-// io.WriteCloser.
-func (c *CompositeDigester) Start(contentType string) {
-	c.closeOpenDigester()
+// newItemDigester constructs the digester for one item of the given
+// content type ("", "file", "dir", "file-estargz", or "dir-estargz"),
+// applying any options that apply to that content type. Content types that
+// need to be closed when the caller is done writing to them are returned
+// as both a digester and an io.Closer; other content types return a nil
+// io.Closer.
+func newItemDigester(contentType string, o digesterOptions) (digester, io.Closer) {
 	switch contentType {
 	case "":
-		c.digesters = append(c.digesters, newSimpleDigester(""))
+		return newSimpleDigester(""), nil
 	case "file", "dir":
-		digester := newTarDigester(contentType)
-		c.closer = digester
-		c.digesters = append(c.digesters, digester)
+		digester := newTarDigesterWithChunkSize(contentType, o.compressor, o.chunkSize)
+		return digester, digester
+	case "file-estargz", "dir-estargz":
+		digester := newEstargzDigester(contentType, o.prioritizedFiles, o.chunkSize)
+		return digester, digester
 	default:
-		panic(fmt.Sprintf(`unrecognized content type: expected "", "file", or "dir", got %q`, contentType))
+		panic(fmt.Sprintf(`unrecognized content type: expected "", "file", "dir", "file-estargz", or "dir-estargz", got %q`, contentType))
+	}
+}
+
+// Start starts recording the digest for a new item ("", "file", "dir",
+// "file-estargz", or "dir-estargz"). The caller should call Hash()
+// immediately after to retrieve the new io.WriteCloser.
+func (c *CompositeDigester) Start(contentType string, options ...DigesterOption) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeOpenDigester()
+	var o digesterOptions
+	for _, option := range options {
+		option(&o)
+	}
+	digester, closer := newItemDigester(contentType, o)
+	c.closer = closer
+	c.digesters = append(c.digesters, digester)
+}
+
+// StartParallel starts recording the digest for a new item, the same as
+// Start, except that the bytes written to the returned io.WriteCloser are
+// digested on a worker goroutine instead of inline. The item still
+// occupies the next slot in submission order for the purposes of Digest's
+// fold, and Digest waits for every outstanding worker before it folds
+// anything. The returned function blocks until that worker has finished and
+// returns any error it encountered; calling it is optional; Digest() will
+// wait for the same worker anyway before it returns.
+func (c *CompositeDigester) StartParallel(contentType string, options ...DigesterOption) (io.WriteCloser, func() error) {
+	c.mu.Lock()
+	c.closeOpenDigester()
+	var o digesterOptions
+	for _, option := range options {
+		option(&o)
+	}
+	itemDigester, itemCloser := newItemDigester(contentType, o)
+	c.digesters = append(c.digesters, itemDigester)
+
+	if c.workerSem == nil {
+		maxWorkers := c.maxWorkers
+		if maxWorkers <= 0 {
+			maxWorkers = runtime.GOMAXPROCS(0)
+		}
+		c.workerSem = make(chan struct{}, maxWorkers)
+	}
+	workerSem := c.workerSem
+	c.mu.Unlock()
+
+	pipeReader, pipeWriter := io.Pipe()
+	done := make(chan struct{})
+	var itemErr error
+	c.parallelWG.Add(1)
+	go func() {
+		defer c.parallelWG.Done()
+		workerSem <- struct{}{}
+		defer func() { <-workerSem }()
+		_, err := io.Copy(itemDigester, pipeReader)
+		if closeErr := itemDigester.Close(); err == nil {
+			err = closeErr
+		}
+		if itemCloser != nil && itemCloser != io.Closer(itemDigester) {
+			if closeErr := itemCloser.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pipeReader.CloseWithError(err)
+		itemErr = err
+		close(done)
+	}()
+
+	wait := func() error {
+		<-done
+		return itemErr
 	}
+	return pipeWriter, wait
 }
 
 // Hash returns the hasher for the current item.
 func (c *CompositeDigester) Hash() io.WriteCloser {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	num := len(c.digesters)
 	if num == 0 {
 		return nil
@@ -203,7 +470,12 @@ func (c *CompositeDigester) Hash() io.WriteCloser {
 // Digest returns the content type and a composite digest over everything
 // that's been digested.
 func (c *CompositeDigester) Digest() (string, digest.Digest) {
+	c.mu.Lock()
 	c.closeOpenDigester()
+	c.mu.Unlock()
+	c.parallelWG.Wait()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	num := len(c.digesters)
 	switch num {
 	case 0:
@@ -225,3 +497,47 @@ func (c *CompositeDigester) Digest() (string, digest.Digest) {
 		return "multi", digest.Canonical.FromString(content)
 	}
 }
+
+// EstargzTOC returns the table of contents and the list of prioritized
+// files recorded by the most recently started "file-estargz" or
+// "dir-estargz" item, for a caller (typically the layer pusher) that needs
+// to annotate the pushed blob with them. It returns nil if the most
+// recently started item wasn't an eStargz item. Like Digest and
+// PerItemChunks, it waits for that item to finish, including any
+// StartParallel worker still writing to it.
+func (c *CompositeDigester) EstargzTOC() (*EstargzTOC, []string) {
+	c.mu.Lock()
+	c.closeOpenDigester()
+	c.mu.Unlock()
+	c.parallelWG.Wait()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	num := len(c.digesters)
+	if num == 0 {
+		return nil, nil
+	}
+	if estargz, ok := c.digesters[num-1].(*estargzDigester); ok {
+		return estargz.TOC()
+	}
+	return nil, nil
+}
+
+// PerItemChunks returns the ChunkDigest values recorded for each item that
+// was started with WithChunkSize, in submission order. Items which weren't
+// started with WithChunkSize, or which don't support chunk digests at all,
+// contribute a nil slice in their place.
+func (c *CompositeDigester) PerItemChunks() [][]ChunkDigest {
+	c.mu.Lock()
+	c.closeOpenDigester()
+	c.mu.Unlock()
+	c.parallelWG.Wait()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	chunks := make([][]ChunkDigest, len(c.digesters))
+	for i, d := range c.digesters {
+		if cd, ok := d.(chunkDigester); ok {
+			chunks[i] = cd.ChunkDigests()
+		}
+	}
+	return chunks
+}
@@ -0,0 +1,90 @@
+package buildah
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// TestCompositeDigesterStartParallelOrder verifies that Digest()'s fold
+// stays in submission order even when parallel items finish out of order.
+func TestCompositeDigesterStartParallelOrder(t *testing.T) {
+	var c CompositeDigester
+
+	slow, slowWait := c.StartParallel("file")
+	fast, fastWait := c.StartParallel("file")
+
+	// Write to the second item first and close it, so it's more likely
+	// to finish before the first if ordering weren't tracked correctly.
+	if _, err := fast.Write(buildTestTar(t, map[string]string{"b.txt": "b"})); err != nil {
+		t.Fatalf("error writing second item: %v", err)
+	}
+	if err := fast.Close(); err != nil {
+		t.Fatalf("error closing second item: %v", err)
+	}
+	if err := fastWait(); err != nil {
+		t.Fatalf("error waiting for second item: %v", err)
+	}
+
+	if _, err := slow.Write(buildTestTar(t, map[string]string{"a.txt": "a"})); err != nil {
+		t.Fatalf("error writing first item: %v", err)
+	}
+	if err := slow.Close(); err != nil {
+		t.Fatalf("error closing first item: %v", err)
+	}
+	if err := slowWait(); err != nil {
+		t.Fatalf("error waiting for first item: %v", err)
+	}
+
+	_, gotDigest := c.Digest()
+
+	var serial CompositeDigester
+	serial.Start("file")
+	if _, err := io.Copy(serial.Hash(), bytes.NewReader(buildTestTar(t, map[string]string{"a.txt": "a"}))); err != nil {
+		t.Fatalf("error writing to serial first item: %v", err)
+	}
+	serial.Start("file")
+	if _, err := io.Copy(serial.Hash(), bytes.NewReader(buildTestTar(t, map[string]string{"b.txt": "b"}))); err != nil {
+		t.Fatalf("error writing to serial second item: %v", err)
+	}
+	_, wantDigest := serial.Digest()
+
+	if gotDigest != wantDigest {
+		t.Fatalf("parallel fold order didn't match serial submission order: got %s, want %s", gotDigest, wantDigest)
+	}
+}
+
+// TestCompositeDigesterEstargzTOCWaitsForParallel guards against
+// EstargzTOC() returning a partially-built TOC while a StartParallel
+// worker for the most recently started item is still writing to it.
+func TestCompositeDigesterEstargzTOCWaitsForParallel(t *testing.T) {
+	var c CompositeDigester
+
+	w, wait := c.StartParallel("file-estargz", WithPrioritizedFiles([]string{"a.txt"}))
+	if _, err := w.Write(buildTestTar(t, map[string]string{"a.txt": "hello"})); err != nil {
+		t.Fatalf("error writing item: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("error closing item: %v", err)
+	}
+
+	toc, prioritized := c.EstargzTOC()
+	if err := wait(); err != nil {
+		t.Fatalf("error waiting for worker: %v", err)
+	}
+	if toc == nil {
+		t.Fatalf("expected a non-nil TOC")
+	}
+	if len(prioritized) != 1 {
+		t.Fatalf("expected 1 prioritized file, got %d", len(prioritized))
+	}
+	found := false
+	for _, entry := range toc.Entries {
+		if entry.Name == "a.txt" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected the TOC returned by EstargzTOC to already include a.txt")
+	}
+}
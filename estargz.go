@@ -0,0 +1,395 @@
+package buildah
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// estargzChunkSize is the default size of the pieces that a file's
+	// contents are split into before each piece is gzip-compressed on
+	// its own, so that a remote snapshotter can fetch and decompress a
+	// single chunk without reading the whole file.
+	estargzChunkSize = 4 * 1024 * 1024
+
+	// estargzTOCName is the name given to the tar entry that carries the
+	// layer's JSON table of contents.
+	estargzTOCName = "stargz.index.json"
+
+	// estargzFooterSize is the fixed size, in bytes, of the gzip stream
+	// that every eStargz layer is required to end with, and which
+	// encodes the offset at which the TOC entry's gzip stream begins.
+	estargzFooterSize = 51
+
+	// estargzPrefetchLandmark is the name recorded in the TOC for a
+	// zero-length marker entry that tells a lazy-pulling snapshotter
+	// where the set of prioritized files ends.
+	estargzPrefetchLandmark = ".prefetch.landmark"
+)
+
+// EstargzTOCEntry describes one file, directory, or chunk of a file's
+// contents in an eStargz layer's table of contents.
+type EstargzTOCEntry struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Size        int64  `json:"size,omitempty"`
+	Offset      int64  `json:"offset,omitempty"`
+	ChunkOffset int64  `json:"chunkOffset,omitempty"`
+	ChunkSize   int64  `json:"chunkSize,omitempty"`
+	ChunkDigest string `json:"chunkDigest,omitempty"`
+	Digest      string `json:"digest,omitempty"`
+}
+
+// EstargzTOC is the JSON document recorded in the stargz.index.json entry
+// of an eStargz layer.
+type EstargzTOC struct {
+	Version int               `json:"version"`
+	Entries []EstargzTOCEntry `json:"entries"`
+}
+
+// estargzFooterBytes builds the fixed-size trailing gzip stream that lets a
+// reader locate the TOC without scanning the whole layer: an empty-content
+// gzip member whose extra field holds an "SG" subfield encoding tocOffset.
+func estargzFooterBytes(tocOffset int64) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, estargzFooterSize))
+	zw, err := gzip.NewWriterLevel(buf, gzip.NoCompression)
+	if err != nil {
+		// gzip.NoCompression is always a valid level.
+		panic(err)
+	}
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOffset)
+	extra := []byte{'S', 'G', 0, 0}
+	binary.LittleEndian.PutUint16(extra[2:4], uint16(len(subfield)))
+	zw.Extra = append(extra, subfield...)
+	if err := zw.Close(); err != nil {
+		panic(err)
+	}
+	if buf.Len() != estargzFooterSize {
+		panic(fmt.Sprintf("internal error: eStargz footer was %d bytes, expected %d", buf.Len(), estargzFooterSize))
+	}
+	return buf.Bytes()
+}
+
+// countingWriter wraps an io.Writer and keeps a running count of the bytes
+// that have been written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// flushingGzipWriter buffers writes and, on Flush, emits everything
+// buffered since the previous Flush as its own self-contained gzip member.
+// Sealing chunks into independent members is what lets a consumer of the
+// finished layer start decompressing at any recorded chunk offset.
+type flushingGzipWriter struct {
+	dest io.Writer
+	buf  bytes.Buffer
+}
+
+func (f *flushingGzipWriter) Write(p []byte) (int, error) {
+	return f.buf.Write(p)
+}
+
+func (f *flushingGzipWriter) Flush() error {
+	if f.buf.Len() == 0 {
+		return nil
+	}
+	zw := gzip.NewWriter(f.dest)
+	if _, err := zw.Write(f.buf.Bytes()); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	f.buf.Reset()
+	return nil
+}
+
+// estargzDigester reads a plain tar stream and rewrites it as an eStargz
+// layer: file contents are split into chunkSize pieces (estargzChunkSize
+// unless overridden), each piece
+// is compressed as its own gzip member so it can be fetched independently,
+// and a JSON table of contents plus the eStargz footer are appended once
+// the last entry has been seen. Its Digest() is the digest of the eStargz
+// bytes it produced, not of the original tar stream.
+type estargzDigester struct {
+	isOpen             bool
+	pipeWriter         *io.PipeWriter
+	wg                 sync.WaitGroup
+	err                error
+	nested             digester
+	contentType        string
+	chunkSize          int64
+	prioritizedFiles   map[string]struct{}
+	sawPrioritizedFile bool
+	toc                EstargzTOC
+	tocMutex           sync.Mutex
+}
+
+// newEstargzDigester returns an estargzDigester which splits each regular
+// file's contents into chunkSize-sized pieces before gzip-compressing each
+// one independently. A chunkSize of zero or less falls back to
+// estargzChunkSize.
+func newEstargzDigester(contentType string, prioritizedFiles []string, chunkSize int64) *estargzDigester {
+	baseType := "file"
+	if contentType == "dir-estargz" {
+		baseType = "dir"
+	}
+	if chunkSize <= 0 {
+		chunkSize = estargzChunkSize
+	}
+	prioritized := make(map[string]struct{}, len(prioritizedFiles))
+	for _, name := range prioritizedFiles {
+		prioritized[name] = struct{}{}
+	}
+	e := &estargzDigester{
+		isOpen:           true,
+		nested:           newSimpleDigester(baseType),
+		contentType:      baseType,
+		chunkSize:        chunkSize,
+		prioritizedFiles: prioritized,
+		toc:              EstargzTOC{Version: 1},
+	}
+	pipeReader, pipeWriter := io.Pipe()
+	e.pipeWriter = pipeWriter
+	e.wg.Add(1)
+	go e.run(pipeReader)
+	return e
+}
+
+func (e *estargzDigester) ContentType() string {
+	return e.contentType
+}
+
+func (e *estargzDigester) Write(p []byte) (int, error) {
+	return e.pipeWriter.Write(p)
+}
+
+func (e *estargzDigester) Close() error {
+	if e.isOpen {
+		e.isOpen = false
+		err := e.pipeWriter.Close()
+		e.wg.Wait()
+		if err != nil {
+			return err
+		}
+		return e.err
+	}
+	return nil
+}
+
+func (e *estargzDigester) Digest() digest.Digest {
+	return e.nested.Digest()
+}
+
+// TOC returns the table of contents built while digesting, along with the
+// names the digester was given as prioritized files, in no particular
+// order, whether or not they appeared in the stream. The TOC's entries
+// themselves carry no priority flag.
+func (e *estargzDigester) TOC() (*EstargzTOC, []string) {
+	e.tocMutex.Lock()
+	defer e.tocMutex.Unlock()
+	toc := e.toc
+	var prioritized []string
+	for name := range e.prioritizedFiles {
+		prioritized = append(prioritized, name)
+	}
+	return &toc, prioritized
+}
+
+func (e *estargzDigester) run(pipeReader *io.PipeReader) {
+	defer e.wg.Done()
+	defer pipeReader.Close()
+
+	sink := &countingWriter{w: e.nested}
+	fgw := &flushingGzipWriter{dest: sink}
+	tarWriter := tar.NewWriter(fgw)
+	tarReader := tar.NewReader(pipeReader)
+
+	err := e.copyEntries(tarReader, tarWriter, fgw, sink)
+	if err == io.EOF {
+		err = nil
+	}
+	if err == nil && e.sawPrioritizedFile {
+		err = e.writeLandmark(tarWriter, fgw, sink)
+	}
+	if err == nil {
+		err = e.writeTOCAndFooter(tarWriter, fgw, sink)
+	}
+	if closeErr := tarWriter.Close(); err == nil {
+		err = closeErr
+	}
+	if flushErr := fgw.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := e.nested.Close(); err == nil {
+		err = closeErr
+	}
+	e.err = err
+}
+
+func (e *estargzDigester) copyEntries(tarReader *tar.Reader, tarWriter *tar.Writer, fgw *flushingGzipWriter, sink *countingWriter) error {
+	for {
+		hdr, err := tarReader.Next()
+		if err != nil {
+			return err
+		}
+		if err := fgw.Flush(); err != nil {
+			return errors.Wrapf(err, "error sealing eStargz chunk before %q", hdr.Name)
+		}
+		entryOffset := sink.n
+		if err := tarWriter.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "error writing eStargz header for %q", hdr.Name)
+		}
+		entry := EstargzTOCEntry{
+			Name:   hdr.Name,
+			Type:   typeString(hdr.Typeflag),
+			Size:   hdr.Size,
+			Offset: entryOffset,
+		}
+		if hdr.Size > 0 {
+			fileDigester := sha256.New()
+			var chunks []EstargzTOCEntry
+			remaining := hdr.Size
+			for remaining > 0 {
+				chunkSize := e.chunkSize
+				if remaining < chunkSize {
+					chunkSize = remaining
+				}
+				streamOffset := sink.n
+				fileOffset := hdr.Size - remaining
+				chunkDigester := sha256.New()
+				n, err := io.CopyN(io.MultiWriter(tarWriter, fileDigester, chunkDigester), tarReader, chunkSize)
+				if err != nil {
+					return errors.Wrapf(err, "error copying content for %q", hdr.Name)
+				}
+				if err := fgw.Flush(); err != nil {
+					return errors.Wrapf(err, "error sealing eStargz chunk for %q", hdr.Name)
+				}
+				chunk := entry
+				chunk.Offset = streamOffset
+				chunk.ChunkOffset = fileOffset
+				chunk.ChunkSize = n
+				chunk.ChunkDigest = "sha256:" + hex.EncodeToString(chunkDigester.Sum(nil))
+				remaining -= n
+				chunks = append(chunks, chunk)
+			}
+			fileDigest := "sha256:" + hex.EncodeToString(fileDigester.Sum(nil))
+			for i := range chunks {
+				chunks[i].Digest = fileDigest
+			}
+			e.tocMutex.Lock()
+			e.toc.Entries = append(e.toc.Entries, chunks...)
+			e.tocMutex.Unlock()
+		} else {
+			e.tocMutex.Lock()
+			e.toc.Entries = append(e.toc.Entries, entry)
+			e.tocMutex.Unlock()
+		}
+		if _, prioritized := e.prioritizedFiles[hdr.Name]; prioritized {
+			e.sawPrioritizedFile = true
+		}
+	}
+}
+
+// writeLandmark appends a single real, zero-byte ".prefetch.landmark" tar
+// entry marking the point in the stream at which every prioritized file has
+// already been written, and records its actual offset in the TOC. It's
+// called at most once, after the last entry has been copied, so that N
+// prioritized files produce one landmark instead of N duplicates.
+func (e *estargzDigester) writeLandmark(tarWriter *tar.Writer, fgw *flushingGzipWriter, sink *countingWriter) error {
+	if err := fgw.Flush(); err != nil {
+		return errors.Wrap(err, "error sealing eStargz chunk before prefetch landmark")
+	}
+	offset := sink.n
+	hdr := &tar.Header{
+		Name: estargzPrefetchLandmark,
+		Mode: 0644,
+		Size: 0,
+	}
+	if err := tarWriter.WriteHeader(hdr); err != nil {
+		return errors.Wrap(err, "error writing eStargz prefetch landmark header")
+	}
+	if err := fgw.Flush(); err != nil {
+		return errors.Wrap(err, "error sealing eStargz chunk for prefetch landmark")
+	}
+	e.tocMutex.Lock()
+	e.toc.Entries = append(e.toc.Entries, EstargzTOCEntry{
+		Name:   estargzPrefetchLandmark,
+		Type:   "reg",
+		Offset: offset,
+	})
+	e.tocMutex.Unlock()
+	return nil
+}
+
+func (e *estargzDigester) writeTOCAndFooter(tarWriter *tar.Writer, fgw *flushingGzipWriter, sink *countingWriter) error {
+	e.tocMutex.Lock()
+	tocBytes, err := json.Marshal(&e.toc)
+	e.tocMutex.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "error marshaling eStargz table of contents")
+	}
+	if err := fgw.Flush(); err != nil {
+		return err
+	}
+	tocOffset := sink.n
+	tocHeader := &tar.Header{
+		Name: estargzTOCName,
+		Mode: 0644,
+		Size: int64(len(tocBytes)),
+	}
+	if err := tarWriter.WriteHeader(tocHeader); err != nil {
+		return errors.Wrap(err, "error writing eStargz table of contents header")
+	}
+	if _, err := tarWriter.Write(tocBytes); err != nil {
+		return errors.Wrap(err, "error writing eStargz table of contents")
+	}
+	if err := fgw.Flush(); err != nil {
+		return err
+	}
+	if _, err := sink.Write(estargzFooterBytes(tocOffset)); err != nil {
+		return errors.Wrap(err, "error writing eStargz footer")
+	}
+	return nil
+}
+
+// typeString converts a tar header's Typeflag into the short strings used
+// in the eStargz TOC ("reg", "dir", "symlink", and so on).
+func typeString(flag byte) string {
+	switch flag {
+	case tar.TypeReg, tar.TypeRegA:
+		return "reg"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeChar:
+		return "char"
+	case tar.TypeBlock:
+		return "block"
+	case tar.TypeFifo:
+		return "fifo"
+	default:
+		return "reg"
+	}
+}
@@ -0,0 +1,214 @@
+package buildah
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+)
+
+// buildTestTar writes a minimal tar stream containing the given regular
+// files, for feeding to a digester.
+func buildTestTar(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, contents := range files {
+		hdr := &tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(contents)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("error writing header for %q: %v", name, err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatalf("error writing contents for %q: %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("error closing tar writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// digestTestLayer feeds input through a fresh estargzDigester and returns
+// its TOC.
+func digestTestLayer(t *testing.T, input []byte, prioritized []string) *EstargzTOC {
+	t.Helper()
+	d := newEstargzDigester("file-estargz", prioritized, 0)
+	if _, err := d.Write(input); err != nil {
+		t.Fatalf("error writing to digester: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("error closing digester: %v", err)
+	}
+	toc, gotPrioritized := d.TOC()
+	if len(gotPrioritized) != len(prioritized) {
+		t.Fatalf("expected %d prioritized files, got %d", len(prioritized), len(gotPrioritized))
+	}
+	return toc
+}
+
+func TestEstargzDigesterLandmarkIsSingleEntry(t *testing.T) {
+	input := buildTestTar(t, map[string]string{
+		"a.txt": "hello",
+		"b.txt": "world",
+	})
+
+	toc := digestTestLayer(t, input, []string{"a.txt", "b.txt"})
+
+	var landmarks []EstargzTOCEntry
+	for _, entry := range toc.Entries {
+		if entry.Name == estargzPrefetchLandmark {
+			landmarks = append(landmarks, entry)
+		}
+	}
+	if len(landmarks) != 1 {
+		t.Fatalf("expected exactly 1 prefetch landmark entry for 2 prioritized files, got %d", len(landmarks))
+	}
+	if landmarks[0].Offset == 0 {
+		t.Fatalf("landmark entry has no recorded offset")
+	}
+}
+
+func TestEstargzDigesterNoLandmarkWithoutPrioritizedFiles(t *testing.T) {
+	input := buildTestTar(t, map[string]string{"a.txt": "hello"})
+
+	toc := digestTestLayer(t, input, nil)
+	for _, entry := range toc.Entries {
+		if entry.Name == estargzPrefetchLandmark {
+			t.Fatalf("unexpected prefetch landmark entry when no files were prioritized")
+		}
+	}
+}
+
+// TestEstargzLandmarkIsRealTarEntry drives copyEntries and writeLandmark
+// directly against a capturing sink so the produced bytes can be
+// decompressed and walked as a tar stream, confirming the landmark the TOC
+// records is backed by an actual entry rather than a TOC-only phantom.
+func TestEstargzLandmarkIsRealTarEntry(t *testing.T) {
+	input := buildTestTar(t, map[string]string{"a.txt": "hello"})
+
+	e := &estargzDigester{
+		chunkSize:        estargzChunkSize,
+		prioritizedFiles: map[string]struct{}{"a.txt": {}},
+		toc:              EstargzTOC{Version: 1},
+	}
+
+	out := &bytes.Buffer{}
+	sink := &countingWriter{w: out}
+	fgw := &flushingGzipWriter{dest: sink}
+	tarWriter := tar.NewWriter(fgw)
+	tarReader := tar.NewReader(bytes.NewReader(input))
+
+	err := e.copyEntries(tarReader, tarWriter, fgw, sink)
+	if err != io.EOF {
+		t.Fatalf("unexpected copyEntries error: %v", err)
+	}
+	if !e.sawPrioritizedFile {
+		t.Fatalf("expected copyEntries to flag a.txt as prioritized")
+	}
+	if err := e.writeLandmark(tarWriter, fgw, sink); err != nil {
+		t.Fatalf("error writing landmark: %v", err)
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatalf("error closing tar writer: %v", err)
+	}
+	if err := fgw.Flush(); err != nil {
+		t.Fatalf("error flushing trailing gzip member: %v", err)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("error opening gzip stream: %v", err)
+	}
+	tr := tar.NewReader(zr)
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("error reading tar entries from produced layer: %v", err)
+		}
+		if hdr.Name == estargzPrefetchLandmark {
+			found = true
+			if hdr.Size != 0 {
+				t.Fatalf("expected zero-byte landmark entry, got size %d", hdr.Size)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("no real tar entry found for the prefetch landmark")
+	}
+}
+
+// TestEstargzDigesterChunkOffsetIsWithinFile guards against ChunkOffset
+// being confused with Offset: for a file spanning several chunks,
+// ChunkOffset must be the byte position within the file's decompressed
+// content (0, chunkSize, 2*chunkSize, …), not the stream position where the
+// chunk's gzip member happens to start.
+func TestEstargzDigesterChunkOffsetIsWithinFile(t *testing.T) {
+	content := strings.Repeat("0123456789", 5) // 50 bytes
+	input := buildTestTar(t, map[string]string{"big.txt": content})
+
+	d := newEstargzDigester("file-estargz", nil, 16)
+	if _, err := d.Write(input); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("error closing: %v", err)
+	}
+	toc, _ := d.TOC()
+
+	var chunks []EstargzTOCEntry
+	for _, entry := range toc.Entries {
+		if entry.Name == "big.txt" {
+			chunks = append(chunks, entry)
+		}
+	}
+	wantChunkOffsets := []int64{0, 16, 32, 48}
+	if len(chunks) != len(wantChunkOffsets) {
+		t.Fatalf("expected %d chunks for a %d-byte file with chunk size 16, got %d", len(wantChunkOffsets), len(content), len(chunks))
+	}
+	for i, chunk := range chunks {
+		if chunk.ChunkOffset != wantChunkOffsets[i] {
+			t.Fatalf("chunk %d: expected ChunkOffset %d (offset within the file), got %d", i, wantChunkOffsets[i], chunk.ChunkOffset)
+		}
+	}
+	// Each chunk is sealed into its own gzip member, so the stream
+	// offset must strictly increase between chunks and must not be
+	// mistaken for the in-file offset checked above.
+	for i := 1; i < len(chunks); i++ {
+		if chunks[i].Offset <= chunks[i-1].Offset {
+			t.Fatalf("chunk %d: expected increasing stream Offset, got %d after %d", i, chunks[i].Offset, chunks[i-1].Offset)
+		}
+	}
+}
+
+// TestEstargzDigesterHonorsChunkSizeOption verifies that WithChunkSize
+// reaches the eStargz digester, not just the plain tar digester.
+func TestEstargzDigesterHonorsChunkSizeOption(t *testing.T) {
+	var c CompositeDigester
+	c.Start("file-estargz", WithChunkSize(8))
+	content := strings.Repeat("x", 20)
+	if _, err := c.Hash().Write(buildTestTar(t, map[string]string{"f": content})); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	toc, _ := c.EstargzTOC()
+
+	var chunks int
+	for _, entry := range toc.Entries {
+		if entry.Name == "f" {
+			chunks++
+		}
+	}
+	if want := 3; chunks != want { // 20 bytes / 8-byte chunks -> 8, 8, 4
+		t.Fatalf("expected %d chunks with WithChunkSize(8) for a 20-byte file, got %d", want, chunks)
+	}
+}
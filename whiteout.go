@@ -0,0 +1,151 @@
+package buildah
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	// aufsWhiteoutPrefix marks a regular file as an AUFS-style whiteout
+	// for the sibling with the rest of its name.
+	aufsWhiteoutPrefix = ".wh."
+	// aufsOpaqueMarker is the name of the AUFS-style marker file that,
+	// when present in a directory, makes that directory opaque.
+	aufsOpaqueMarker = ".wh..wh..opq"
+	// overlayOpaqueXattr is the xattr that overlayfs sets on a
+	// directory to mark it opaque.
+	overlayOpaqueXattr = "trusted.overlay.opaque"
+	// overlayOpaqueXattrPAXRecord is the PAX record key under which
+	// archive/tar stores overlayOpaqueXattr when reading or writing
+	// modern (PAX-format) tar headers.
+	overlayOpaqueXattrPAXRecord = "SCHILY.xattr." + overlayOpaqueXattr
+)
+
+// OverlayWhiteoutToAUFSFilter is a TarEntryFilter, for use with
+// newTarFiltererV2, which rewrites overlayfs whiteout conventions into
+// their AUFS equivalents: a character device with major/minor 0/0 becomes
+// a zero-length regular file named ".wh.<original name>", and a directory
+// carrying the "trusted.overlay.opaque=y" xattr gets a ".wh..wh..opq"
+// marker entry inserted as its first child, with the xattr itself stripped
+// from the directory's own header since AUFS has no use for it. It's useful
+// when buildah reads
+// layers written by an overlay-based graph driver but needs to hand them
+// to a driver that only understands AUFS whiteouts, such as when importing
+// or exporting images across graph drivers.
+func OverlayWhiteoutToAUFSFilter(hdr *tar.Header, contents io.Reader) (*tar.Header, io.Reader, []tar.Header, error) {
+	if isOverlayWhiteout(hdr) {
+		newHdr := *hdr
+		dir, name := path.Split(hdr.Name)
+		newHdr.Name = dir + aufsWhiteoutPrefix + name
+		newHdr.Typeflag = tar.TypeReg
+		newHdr.Mode = 0600
+		newHdr.Size = 0
+		newHdr.Devmajor = 0
+		newHdr.Devminor = 0
+		return &newHdr, bytes.NewReader(nil), nil, nil
+	}
+	var extra []tar.Header
+	if hdr.Typeflag == tar.TypeDir && isOverlayOpaque(hdr) {
+		opaque := *hdr
+		opaque.Name = path.Join(hdr.Name, aufsOpaqueMarker)
+		opaque.Typeflag = tar.TypeReg
+		opaque.Size = 0
+		opaque.Xattrs = nil
+		opaque.PAXRecords = nil
+		extra = append(extra, opaque)
+
+		// The directory itself no longer needs the overlay opaque
+		// xattr: the marker entry above now carries that meaning in
+		// AUFS terms, and leaving it in place would hand the xattr
+		// down to a reader that doesn't understand it.
+		newHdr := *hdr
+		newHdr.Xattrs = stripXattr(hdr.Xattrs, overlayOpaqueXattr)
+		newHdr.PAXRecords = stripXattr(hdr.PAXRecords, overlayOpaqueXattrPAXRecord)
+		return &newHdr, contents, extra, nil
+	}
+	return hdr, contents, extra, nil
+}
+
+// stripXattr returns a copy of m with key removed, so the original header's
+// map isn't mutated out from under any other reference to it. Returns nil if
+// the result would be empty.
+func stripXattr(m map[string]string, key string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	cp := make(map[string]string, len(m))
+	for k, v := range m {
+		if k != key {
+			cp[k] = v
+		}
+	}
+	if len(cp) == 0 {
+		return nil
+	}
+	return cp
+}
+
+// OverlayOpaqueApplier is called by the filter returned from
+// NewAUFSWhiteoutToOverlayFilter for each directory that carried an AUFS
+// ".wh..wh..opq" opaque marker, so that the caller can set the
+// "trusted.overlay.opaque=y" xattr directly on the directory it already
+// extracted, with the mode and ownership it actually has.
+type OverlayOpaqueApplier func(dir string) error
+
+// NewAUFSWhiteoutToOverlayFilter returns a TarEntryFilter, for use with
+// newTarFiltererV2, which performs the reverse translation of
+// OverlayWhiteoutToAUFSFilter: a ".wh.<name>" regular file becomes a
+// character device with major/minor 0/0 named "<name>", and a
+// ".wh..wh..opq" marker entry is dropped and, if applyOpaque is non-nil,
+// reported to it by the path of the directory it marks as opaque.
+//
+// A single-entry streaming filter has no access to that directory's real
+// mode, uid, or gid, so applyOpaque must apply the xattr to the directory
+// the caller already extracted rather than have the filter fabricate a
+// synthetic directory header, which would otherwise reset its permissions
+// and ownership to a guessed value on extraction.
+func NewAUFSWhiteoutToOverlayFilter(applyOpaque OverlayOpaqueApplier) TarEntryFilter {
+	return func(hdr *tar.Header, contents io.Reader) (*tar.Header, io.Reader, []tar.Header, error) {
+		dir, name := path.Split(hdr.Name)
+		if name == aufsOpaqueMarker {
+			if applyOpaque != nil {
+				if err := applyOpaque(strings.TrimSuffix(dir, "/")); err != nil {
+					return nil, nil, nil, err
+				}
+			}
+			return nil, nil, nil, nil
+		}
+		if strings.HasPrefix(name, aufsWhiteoutPrefix) {
+			newHdr := *hdr
+			newHdr.Name = dir + strings.TrimPrefix(name, aufsWhiteoutPrefix)
+			newHdr.Typeflag = tar.TypeChar
+			newHdr.Mode = 0600
+			newHdr.Size = 0
+			newHdr.Devmajor = 0
+			newHdr.Devminor = 0
+			return &newHdr, bytes.NewReader(nil), nil, nil
+		}
+		return hdr, contents, nil, nil
+	}
+}
+
+// isOverlayWhiteout returns true if hdr represents an overlayfs whiteout:
+// a character device with both major and minor numbers set to 0.
+func isOverlayWhiteout(hdr *tar.Header) bool {
+	return hdr.Typeflag == tar.TypeChar && hdr.Devmajor == 0 && hdr.Devminor == 0
+}
+
+// isOverlayOpaque returns true if hdr carries the xattr that overlayfs
+// uses to mark a directory as opaque.
+func isOverlayOpaque(hdr *tar.Header) bool {
+	if v, ok := hdr.PAXRecords[overlayOpaqueXattrPAXRecord]; ok && v == "y" {
+		return true
+	}
+	if v, ok := hdr.Xattrs[overlayOpaqueXattr]; ok && v == "y" { //nolint:staticcheck // Xattrs is deprecated but still populated by some readers
+		return true
+	}
+	return false
+}
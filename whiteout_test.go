@@ -0,0 +1,112 @@
+package buildah
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+)
+
+func filterTar(t *testing.T, input []byte, filter TarEntryFilter) []byte {
+	t.Helper()
+	out := &bytes.Buffer{}
+	filterer := newTarFiltererV2(nopWriteCloser{out}, filter)
+	if _, err := filterer.Write(input); err != nil {
+		t.Fatalf("error writing input: %v", err)
+	}
+	if err := filterer.Close(); err != nil {
+		t.Fatalf("error closing filterer: %v", err)
+	}
+	return out.Bytes()
+}
+
+func readTarHeaders(t *testing.T, b []byte) []*tar.Header {
+	t.Helper()
+	var hdrs []*tar.Header
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		hdrs = append(hdrs, hdr)
+	}
+	return hdrs
+}
+
+func TestOverlayWhiteoutToAUFSFilter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "deleted", Typeflag: tar.TypeChar, Devmajor: 0, Devminor: 0}); err != nil {
+		t.Fatalf("error writing whiteout header: %v", err)
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "opaquedir/",
+		Typeflag: tar.TypeDir,
+		Mode:     0700,
+		PAXRecords: map[string]string{
+			overlayOpaqueXattrPAXRecord: "y",
+		},
+	}); err != nil {
+		t.Fatalf("error writing opaque dir header: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("error closing tar writer: %v", err)
+	}
+
+	out := filterTar(t, buf.Bytes(), OverlayWhiteoutToAUFSFilter)
+	hdrs := readTarHeaders(t, out)
+
+	if len(hdrs) != 3 {
+		t.Fatalf("expected 3 entries (whiteout, dir, opaque marker), got %d", len(hdrs))
+	}
+	if hdrs[0].Name != ".wh.deleted" || hdrs[0].Typeflag != tar.TypeReg {
+		t.Fatalf("expected .wh.deleted regular file, got %q type %c", hdrs[0].Name, hdrs[0].Typeflag)
+	}
+	if hdrs[1].Name != "opaquedir/" {
+		t.Fatalf("expected opaquedir/ to pass through, got %q", hdrs[1].Name)
+	}
+	if _, ok := hdrs[1].PAXRecords[overlayOpaqueXattrPAXRecord]; ok {
+		t.Fatalf("expected overlay opaque PAX record to be stripped from the directory header, got %+v", hdrs[1].PAXRecords)
+	}
+	if hdrs[2].Name != "opaquedir/.wh..wh..opq" {
+		t.Fatalf("expected opaque marker entry, got %q", hdrs[2].Name)
+	}
+}
+
+func TestAUFSWhiteoutToOverlayFilter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: ".wh.deleted", Typeflag: tar.TypeReg, Mode: 0600}); err != nil {
+		t.Fatalf("error writing whiteout header: %v", err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "opaquedir/", Typeflag: tar.TypeDir, Mode: 0700}); err != nil {
+		t.Fatalf("error writing dir header: %v", err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "opaquedir/.wh..wh..opq", Typeflag: tar.TypeReg}); err != nil {
+		t.Fatalf("error writing opaque marker header: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("error closing tar writer: %v", err)
+	}
+
+	var appliedTo []string
+	filter := NewAUFSWhiteoutToOverlayFilter(func(dir string) error {
+		appliedTo = append(appliedTo, dir)
+		return nil
+	})
+	out := filterTar(t, buf.Bytes(), filter)
+	hdrs := readTarHeaders(t, out)
+
+	if len(hdrs) != 2 {
+		t.Fatalf("expected 2 entries (overlay whiteout, dir), got %d", len(hdrs))
+	}
+	if hdrs[0].Name != "deleted" || hdrs[0].Typeflag != tar.TypeChar || hdrs[0].Devmajor != 0 || hdrs[0].Devminor != 0 {
+		t.Fatalf("expected overlay char-device whiteout named %q, got %+v", "deleted", hdrs[0])
+	}
+	if hdrs[1].Name != "opaquedir/" || hdrs[1].Mode != 0700 {
+		t.Fatalf("expected opaquedir/ to pass through with its real mode preserved, got %+v", hdrs[1])
+	}
+	if len(appliedTo) != 1 || appliedTo[0] != "opaquedir" {
+		t.Fatalf("expected applyOpaque to be called once with %q, got %v", "opaquedir", appliedTo)
+	}
+}